@@ -5,10 +5,11 @@
 package api
 
 import (
-	"bufio"
-	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"sync"
+	"time"
 
 	"github.com/tsuru/tsuru/api/context"
 	"github.com/tsuru/tsuru/app"
@@ -16,13 +17,63 @@ import (
 	"golang.org/x/net/websocket"
 )
 
+// logWriteScope lets a non-internal agent stream application logs over
+// addLogs without impersonating app.InternalAppName, as long as its
+// token carries this scope.
+const logWriteScope = "logs:write"
+
+// scopedToken is implemented by auth.Token implementations that carry
+// fine-grained scopes. It's checked with a type assertion so tokens that
+// predate scopes keep working, restricted to app.InternalAppName as
+// before.
+type scopedToken interface {
+	Scopes() []string
+}
+
+// canSubmitLogsFor reports whether a token authenticated as tokenApp may
+// submit log entries tagged with entryApp: either the same app, or the
+// internal token shared by node/unit agents, which submits on behalf of
+// every app.
+func canSubmitLogsFor(tokenApp, entryApp string) bool {
+	return tokenApp == app.InternalAppName || tokenApp == entryApp
+}
+
+func hasLogWriteScope(t interface{ GetAppName() string }) bool {
+	st, ok := t.(scopedToken)
+	if !ok {
+		return false
+	}
+	for _, scope := range st.Scopes() {
+		if scope == logWriteScope {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	shutdownCh   = make(chan struct{})
+	shutdownOnce sync.Once
+)
+
+// StopLogIngestion signals every addLogs connection currently streaming
+// logs to stop accepting new lines, flush its dispatcher and close its
+// WebSocket cleanly. It's meant to be called once, from the process'
+// termination handler, before the yati process exits, so in-flight log
+// batches aren't lost.
+func StopLogIngestion() {
+	shutdownOnce.Do(func() { close(shutdownCh) })
+}
+
 func addLogs(ws *websocket.Conn) {
+	wsConfigOnce.Do(loadWSConfig)
 	var err error
+	logger := log.With(log.Field{Key: "source", Value: "wslogs"})
 	defer func() {
 		data := map[string]interface{}{}
 		if err != nil {
 			data["error"] = err.Error()
-			log.Error(err.Error())
+			logger.Error(err.Error())
 		} else {
 			data["error"] = nil
 		}
@@ -33,43 +84,91 @@ func addLogs(ws *websocket.Conn) {
 	req := ws.Request()
 	t := context.GetAuthToken(req)
 	if t == nil {
-		err = fmt.Errorf("wslogs: no token")
+		err = fmt.Errorf("no token")
 		return
 	}
-	if t.GetAppName() != app.InternalAppName {
-		err = fmt.Errorf("wslogs: invalid token app name: %q", t.GetAppName())
+	if t.GetAppName() != app.InternalAppName && !hasLogWriteScope(t) {
+		err = fmt.Errorf("invalid token app name: %q", t.GetAppName())
 		return
 	}
+	logger = logger.With(log.Field{Key: "app", Value: t.GetAppName()})
+	protocol := selectedProtocol(ws)
+	reader := newLogFrameReader(ws, protocol)
 	dispatcher := app.NewlogDispatcher()
-	scanner := bufio.NewScanner(ws)
-	for scanner.Scan() {
-		var entry app.Applog
-		data := bytes.TrimSpace(scanner.Bytes())
-		if len(data) == 0 {
-			continue
+
+	// done tells every goroutine spawned below to stop as soon as the
+	// main loop exits, however it exits, so none of them are left
+	// blocked on a send nobody will ever receive again.
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if perr := sendPing(ws, protocol); perr != nil {
+					return
+				}
+			}
 		}
-		err = json.Unmarshal(data, &entry)
-		if err != nil {
-			dispatcher.Stop()
-			err = fmt.Errorf("wslogs: parsing log line %q: %s", string(data), err)
-			return
+	}()
+
+	type frame struct {
+		entries []*app.Applog
+		err     error
+	}
+	frames := make(chan frame)
+	go func() {
+		for {
+			entries, rerr := reader.ReadBatch()
+			select {
+			case frames <- frame{entries: entries, err: rerr}:
+			case <-done:
+				return
+			}
+			if rerr != nil {
+				return
+			}
 		}
-		err = dispatcher.Send(&entry)
-		if err != nil {
-			// Do not disconnect by returning here, dispatcher will already
-			// retry db connection and we gain nothing by ending the WS
-			// connection.
-			log.Errorf("wslogs: error storing log: %s", err)
+	}()
+
+loop:
+	for {
+		ws.SetReadDeadline(time.Now().Add(pongTimeout))
+		select {
+		case <-shutdownCh:
+			break loop
+		case f := <-frames:
+			if f.err != nil {
+				if f.err != io.EOF {
+					dispatcher.Stop()
+					err = fmt.Errorf("parsing log frame (protocol %q): %s", protocol, f.err)
+					return
+				}
+				break loop
+			}
+			for _, entry := range f.entries {
+				if !canSubmitLogsFor(t.GetAppName(), entry.AppName) {
+					dispatcher.Stop()
+					err = fmt.Errorf("token for app %q cannot submit logs for app %q", t.GetAppName(), entry.AppName)
+					return
+				}
+				if serr := dispatcher.Send(entry); serr != nil {
+					// Do not disconnect by returning here, dispatcher will already
+					// retry db connection and we gain nothing by ending the WS
+					// connection.
+					logger.Error("error storing log", log.Field{Key: "unit", Value: entry.Unit}, log.Field{Key: "error", Value: serr.Error()})
+				}
+			}
 		}
 	}
 	err = dispatcher.Stop()
 	if err != nil {
-		err = fmt.Errorf("wslogs: error storing log: %s", err)
-		return
-	}
-	err = scanner.Err()
-	if err != nil {
-		err = fmt.Errorf("wslogs: waiting for log data: %s", err)
+		err = fmt.Errorf("error storing log: %s", err)
 		return
 	}
 }
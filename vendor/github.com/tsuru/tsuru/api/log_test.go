@@ -0,0 +1,30 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"testing"
+
+	"github.com/tsuru/tsuru/app"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+func (s *S) TestCanSubmitLogsForSameApp(c *check.C) {
+	c.Assert(canSubmitLogsFor("myapp", "myapp"), check.Equals, true)
+}
+
+func (s *S) TestCanSubmitLogsForDifferentAppIsRejected(c *check.C) {
+	c.Assert(canSubmitLogsFor("myapp", "otherapp"), check.Equals, false)
+}
+
+func (s *S) TestCanSubmitLogsForInternalTokenAllowsAnyApp(c *check.C) {
+	c.Assert(canSubmitLogsFor(app.InternalAppName, "otherapp"), check.Equals, true)
+}
@@ -0,0 +1,199 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/app"
+	"github.com/tsuru/tsuru/app/logpb"
+	"github.com/vmihailenco/msgpack"
+	"golang.org/x/net/websocket"
+)
+
+// Sub-protocols accepted by addLogs, negotiated through the
+// Sec-WebSocket-Protocol header. Framing differs per protocol: ndjson is
+// one JSON object per text line (the original, still default, framing),
+// while msgpack and protobuf are binary, one encoded Batch per WS
+// message.
+const (
+	protocolNDJSON   = "yati.logs.v1.ndjson"
+	protocolMsgpack  = "yati.logs.v1.msgpack"
+	protocolProtobuf = "yati.logs.v1.protobuf"
+)
+
+// pingInterval/pongTimeout bound how long addLogs waits for any data
+// (including empty "pong" frames, see logFrameReader) before assuming
+// the TCP connection is dead. golang.org/x/net/websocket has no native
+// ping/pong control frames, so liveness is carried over the same framing
+// as log data: an empty text line for ndjson, an empty binary message
+// for msgpack/protobuf.
+//
+// Both default to the values below and are overridden from
+// "log:ws:ping-interval" and "log:ws:pong-timeout" (in seconds) by
+// loadWSConfig, the first time addLogs runs.
+var (
+	pingInterval = 30 * time.Second
+	pongTimeout  = 90 * time.Second
+)
+
+var wsConfigOnce sync.Once
+
+// loadWSConfig overrides pingInterval and pongTimeout from config, the
+// same way newLogStorage/newLogBroker pick their backend. Called once,
+// lazily, so it runs after the process has loaded its config file.
+func loadWSConfig() {
+	if secs, err := config.GetInt("log:ws:ping-interval"); err == nil {
+		pingInterval = time.Duration(secs) * time.Second
+	}
+	if secs, err := config.GetInt("log:ws:pong-timeout"); err == nil {
+		pongTimeout = time.Duration(secs) * time.Second
+	}
+}
+
+// sendPing writes an empty frame in the connection's negotiated
+// framing, prompting a TCP-level ACK from the client (and, for
+// well-behaved clients, an equally empty "pong" frame back) so dead
+// connections surface as a read timeout instead of hanging forever.
+func sendPing(ws *websocket.Conn, protocol string) error {
+	if protocol == protocolNDJSON {
+		_, err := ws.Write([]byte("\n"))
+		return err
+	}
+	return websocket.Message.Send(ws, []byte{})
+}
+
+// logsHandshake implements websocket.Handshake, picking one of the
+// sub-protocols above from the client's Sec-WebSocket-Protocol header and
+// recording it on config.Protocol so the library's handshake response
+// echoes it back, as RFC6455 requires of any server that understands the
+// protocols a client offers. x/net/websocket's default Handshake never
+// sets config.Protocol, so without this a client asking for
+// yati.logs.v1.msgpack or yati.logs.v1.protobuf has its connection
+// closed before a single frame is exchanged.
+func logsHandshake(config *websocket.Config, req *http.Request) error {
+	for _, p := range strings.Split(req.Header.Get("Sec-WebSocket-Protocol"), ",") {
+		switch strings.TrimSpace(p) {
+		case protocolMsgpack, protocolProtobuf, protocolNDJSON:
+			config.Protocol = []string{strings.TrimSpace(p)}
+			return nil
+		}
+	}
+	return nil
+}
+
+// LogsHandler is addLogs wrapped with logsHandshake so the sub-protocol
+// negotiated during the WebSocket handshake is echoed back to the
+// client. Register this, not websocket.Handler(addLogs), as the log
+// ingestion route's handler.
+var LogsHandler = websocket.Server{Handshake: logsHandshake, Handler: addLogs}
+
+// selectedProtocol returns the sub-protocol negotiated by logsHandshake,
+// defaulting to ndjson for clients that don't send
+// Sec-WebSocket-Protocol at all.
+func selectedProtocol(ws *websocket.Conn) string {
+	if protocols := ws.Config().Protocol; len(protocols) > 0 {
+		return protocols[0]
+	}
+	return protocolNDJSON
+}
+
+// logFrameReader reads successive batches of log entries off a
+// WebSocket connection. ReadBatch returns io.EOF once the client is
+// done sending frames, and a nil, empty batch for heartbeat frames.
+type logFrameReader interface {
+	ReadBatch() ([]*app.Applog, error)
+}
+
+func newLogFrameReader(ws *websocket.Conn, protocol string) logFrameReader {
+	switch protocol {
+	case protocolMsgpack:
+		return &binaryFrameReader{ws: ws, unmarshal: unmarshalMsgpackBatch}
+	case protocolProtobuf:
+		return &binaryFrameReader{ws: ws, unmarshal: unmarshalProtobufBatch}
+	default:
+		return &ndjsonFrameReader{scanner: bufio.NewScanner(ws)}
+	}
+}
+
+type ndjsonFrameReader struct {
+	scanner *bufio.Scanner
+}
+
+func (r *ndjsonFrameReader) ReadBatch() ([]*app.Applog, error) {
+	if !r.scanner.Scan() {
+		if err := r.scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	data := bytes.TrimSpace(r.scanner.Bytes())
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var entry app.Applog
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("parsing log line %q: %s", string(data), err)
+	}
+	return []*app.Applog{&entry}, nil
+}
+
+type binaryFrameReader struct {
+	ws        *websocket.Conn
+	unmarshal func([]byte) ([]*app.Applog, error)
+}
+
+func (r *binaryFrameReader) ReadBatch() ([]*app.Applog, error) {
+	var data []byte
+	if err := websocket.Message.Receive(r.ws, &data); err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return r.unmarshal(data)
+}
+
+func unmarshalMsgpackBatch(data []byte) ([]*app.Applog, error) {
+	var batch struct {
+		Entries []*app.Applog `msgpack:"entries"`
+	}
+	if err := msgpack.Unmarshal(data, &batch); err != nil {
+		return nil, fmt.Errorf("parsing msgpack batch: %s", err)
+	}
+	return batch.Entries, nil
+}
+
+func unmarshalProtobufBatch(data []byte) ([]*app.Applog, error) {
+	var pbBatch logpb.Batch
+	if err := proto.Unmarshal(data, &pbBatch); err != nil {
+		return nil, fmt.Errorf("parsing protobuf batch: %s", err)
+	}
+	entries := make([]*app.Applog, len(pbBatch.Entries))
+	for i, e := range pbBatch.Entries {
+		date, err := time.Parse(time.RFC3339Nano, e.Date)
+		if err != nil {
+			return nil, fmt.Errorf("parsing protobuf entry date %q: %s", e.Date, err)
+		}
+		entries[i] = &app.Applog{
+			Date:    date,
+			Message: e.Message,
+			Source:  e.Source,
+			AppName: e.AppName,
+			Unit:    e.Unit,
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,18 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// init exposes the process' Prometheus metrics, including the log
+// dispatch pipeline counters registered by the app package, at /metrics
+// on http.DefaultServeMux.
+func init() {
+	http.Handle("/metrics", promhttp.Handler())
+}
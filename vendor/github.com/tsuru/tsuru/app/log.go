@@ -5,21 +5,60 @@
 package app
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/tsuru/tsuru/db"
+	"github.com/tsuru/config"
 	"github.com/tsuru/tsuru/log"
-	"github.com/tsuru/tsuru/queue"
 )
 
 var LogPubSubQueuePrefix = "pubsub:"
 var bulkMaxWaitTime = 500 * time.Millisecond
 
+// MaxFlushRetries is the number of times runFlusher retries a failed
+// bulk insert, with exponential backoff, before giving up and
+// propagating the error on errCh. Defaults to 5, overridden by
+// "log:dispatcher:max-retries" the first time a dispatcher is created.
+var MaxFlushRetries = 5
+
+var (
+	initialFlushBackoff = 100 * time.Millisecond
+	maxFlushBackoff     = 30 * time.Second
+)
+
+// sendTimeout bounds how long Send waits for room in a dispatcher's
+// msgCh before giving up and dropping the message. Defaults to one
+// second, overridden (in seconds) by "log:dispatcher:send-timeout" the
+// first time a dispatcher is created.
+var sendTimeout = time.Second
+
+var dispatcherConfigOnce sync.Once
+
+// loadDispatcherConfig overrides MaxFlushRetries and sendTimeout from
+// config, the same way newLogStorage/newLogBroker pick their backend.
+// Called once, lazily from newAppLogDispatcher, so it runs after the
+// process has loaded its config file instead of at package init time.
+func loadDispatcherConfig() {
+	if n, err := config.GetInt("log:dispatcher:max-retries"); err == nil {
+		MaxFlushRetries = n
+	}
+	if secs, err := config.GetInt("log:dispatcher:send-timeout"); err == nil {
+		sendTimeout = time.Duration(secs) * time.Second
+	}
+}
+
+// LogListener streams an app's logs from its LogBroker subscription. It
+// no longer owns a raw pub/sub queue: Close just cancels the context
+// passed to LogBroker.Subscribe, which is safe to call more than once,
+// unlike the UnSub-based double-close this type used to guard against
+// with recover().
 type LogListener struct {
-	C <-chan Applog
-	q queue.PubSubQ
+	C      <-chan Applog
+	cancel context.CancelFunc
 }
 
 func logQueueName(appName string) string {
@@ -27,71 +66,45 @@ func logQueueName(appName string) string {
 }
 
 func NewLogListener(a *App, filterLog Applog) (*LogListener, error) {
-	factory, err := queue.Factory()
-	if err != nil {
-		return nil, err
-	}
-	pubSubQ, err := factory.PubSub(logQueueName(a.Name))
+	broker, err := sharedLogBroker()
 	if err != nil {
 		return nil, err
 	}
-	subChan, err := pubSubQ.Sub()
+	ctx, cancel := context.WithCancel(context.Background())
+	c, err := broker.Subscribe(ctx, a.Name, filterLog)
 	if err != nil {
+		cancel()
 		return nil, err
 	}
-	c := make(chan Applog, 10)
+	logListenerActive.WithLabelValues(a.Name).Inc()
 	go func() {
-		defer close(c)
-		for msg := range subChan {
-			applog := Applog{}
-			err := json.Unmarshal(msg, &applog)
-			if err != nil {
-				log.Errorf("Unparsable log message, ignoring: %s", string(msg))
-				continue
-			}
-			if (filterLog.Source == "" || filterLog.Source == applog.Source) &&
-				(filterLog.Unit == "" || filterLog.Unit == applog.Unit) {
-				defer func() {
-					recover()
-				}()
-				c <- applog
-			}
-		}
+		<-ctx.Done()
+		logListenerActive.WithLabelValues(a.Name).Dec()
 	}()
-	l := LogListener{C: c, q: pubSubQ}
-	return &l, nil
+	return &LogListener{C: c, cancel: cancel}, nil
 }
 
-func (l *LogListener) Close() (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = fmt.Errorf("Recovered panic closing listener (possible double close): %#v", r)
-		}
-	}()
-	err = l.q.UnSub()
-	return
+func (l *LogListener) Close() error {
+	l.cancel()
+	return nil
 }
 
 func notify(appName string, messages []interface{}) {
-	factory, err := queue.Factory()
-	if err != nil {
-		log.Errorf("Error on logs notify: %s", err.Error())
-		return
-	}
-	pubSubQ, err := factory.PubSub(logQueueName(appName))
+	logger := log.With(log.Field{Key: "app", Value: appName})
+	broker, err := sharedLogBroker()
 	if err != nil {
-		log.Errorf("Error on logs notify: %s", err.Error())
+		logger.Error("error on logs notify", log.Field{Key: "error", Value: err.Error()})
 		return
 	}
 	for _, msg := range messages {
-		bytes, err := json.Marshal(msg)
-		if err != nil {
-			log.Errorf("Error on logs notify: %s", err.Error())
+		entry, ok := msg.(*Applog)
+		if !ok {
+			logger.Error("error on logs notify", log.Field{Key: "error", Value: fmt.Sprintf("unexpected message type %T", msg)})
 			continue
 		}
-		err = pubSubQ.Pub(bytes)
-		if err != nil {
-			log.Errorf("Error on logs notify: %s", err.Error())
+		if err := broker.Publish(appName, entry); err != nil {
+			logPubSubPublishErrors.WithLabelValues(appName).Inc()
+			logger.Error("error on logs notify", log.Field{Key: "error", Value: err.Error()})
 		}
 	}
 }
@@ -115,10 +128,16 @@ func (d *logDispatcher) Send(msg *Applog) error {
 	}
 	select {
 	case appD.msgCh <- msg:
+		logMessagesReceived.WithLabelValues(appName).Inc()
+		logChannelDepth.WithLabelValues(appName).Set(float64(len(appD.msgCh)))
 	case err := <-appD.errCh:
 		close(appD.msgCh)
 		delete(d.dispatchers, appName)
 		return err
+	case <-time.After(sendTimeout):
+		dropped := atomic.AddUint64(&appD.dropped, 1)
+		logMessagesDropped.WithLabelValues(appName).Inc()
+		appD.logger.Warn("dropping log message, channel is full", log.Field{Key: "dropped_total", Value: dropped})
 	}
 	return nil
 }
@@ -142,15 +161,25 @@ func (d *logDispatcher) Stop() error {
 
 type appLogDispatcher struct {
 	appName string
+	logger  log.FieldLogger
 	msgCh   chan *Applog
 	errCh   chan error
 	done    chan bool
 	toFlush chan *Applog
+	dropped uint64
+}
+
+// Dropped returns the number of messages dropped by Send because this
+// dispatcher's msgCh stayed full for longer than sendTimeout.
+func (d *appLogDispatcher) Dropped() uint64 {
+	return atomic.LoadUint64(&d.dropped)
 }
 
 func newAppLogDispatcher(appName string) *appLogDispatcher {
+	dispatcherConfigOnce.Do(loadDispatcherConfig)
 	d := &appLogDispatcher{
 		appName: appName,
+		logger:  log.With(log.Field{Key: "app", Value: appName}),
 		msgCh:   make(chan *Applog, 10000),
 		errCh:   make(chan error),
 		done:    make(chan bool),
@@ -164,14 +193,14 @@ func newAppLogDispatcher(appName string) *appLogDispatcher {
 func (d *appLogDispatcher) runFlusher() {
 	defer close(d.errCh)
 	t := time.NewTimer(bulkMaxWaitTime)
-	bulkBuffer := make([]interface{}, 0, 100)
-	conn, err := db.LogConn()
+	bulkBuffer := make([]*Applog, 0, 100)
+	storage, err := newLogStorage()
 	if err != nil {
+		d.logger.Error("failed to open log storage", log.Field{Key: "error", Value: err.Error()})
 		d.errCh <- err
 		return
 	}
-	defer conn.Close()
-	coll := conn.Logs(d.appName)
+	defer storage.Close()
 	for {
 		var flush bool
 		select {
@@ -187,16 +216,49 @@ func (d *appLogDispatcher) runFlusher() {
 			flush = len(bulkBuffer) > 0
 		}
 		if flush {
-			err := coll.Insert(bulkBuffer...)
+			start := time.Now()
+			err := d.insertWithRetry(storage, bulkBuffer)
+			logBulkFlushDuration.WithLabelValues(d.appName).Observe(time.Since(start).Seconds())
 			if err != nil {
 				d.errCh <- err
 				return
 			}
+			logBulkSize.Observe(float64(len(bulkBuffer)))
 			bulkBuffer = bulkBuffer[:0]
 		}
 	}
 }
 
+// insertWithRetry calls storage.Insert, retrying up to MaxFlushRetries
+// times with jittered exponential backoff (starting at
+// initialFlushBackoff, capped at maxFlushBackoff) before giving up and
+// returning the last error.
+func (d *appLogDispatcher) insertWithRetry(storage LogStorage, entries []*Applog) error {
+	backoff := initialFlushBackoff
+	var err error
+	for attempt := 0; attempt <= MaxFlushRetries; attempt++ {
+		err = storage.Insert(d.appName, entries)
+		if err == nil {
+			return nil
+		}
+		d.logger.Error("failed to flush logs",
+			log.Field{Key: "bulk_size", Value: len(entries)},
+			log.Field{Key: "attempt", Value: attempt},
+			log.Field{Key: "error", Value: err.Error()},
+		)
+		if attempt == MaxFlushRetries {
+			break
+		}
+		jitter := time.Duration(rand.Int63n(int64(backoff)))
+		time.Sleep(backoff/2 + jitter/2)
+		backoff *= 2
+		if backoff > maxFlushBackoff {
+			backoff = maxFlushBackoff
+		}
+	}
+	return err
+}
+
 func (d *appLogDispatcher) runDBWriter() {
 	defer close(d.done)
 	notifyMessages := make([]interface{}, 1)
@@ -0,0 +1,83 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/tsuru/config"
+)
+
+// LogBroker is the pub/sub transport NewLogListener and notify use to
+// fan log entries out to subscribers. It owns framing, subject/topic
+// naming and subscription lifecycle for its backend; callers only deal
+// in typed Applog values and context cancellation.
+type LogBroker interface {
+	Publish(appName string, entry *Applog) error
+	// Subscribe returns a channel of Applog entries for appName matching
+	// filter, already unmarshalled and filtered. The returned channel is
+	// closed once ctx is done.
+	Subscribe(ctx context.Context, appName string, filter Applog) (<-chan Applog, error)
+	Close() error
+}
+
+// LogBrokerFactory builds a LogBroker from configuration.
+type LogBrokerFactory func() (LogBroker, error)
+
+var logBrokerFactories = make(map[string]LogBrokerFactory)
+
+// RegisterLogBroker makes a LogBroker backend available under name,
+// mirroring RegisterLogStorage.
+func RegisterLogBroker(name string, factory LogBrokerFactory) {
+	logBrokerFactories[name] = factory
+}
+
+// logBrokerBackend returns the configured "log:broker" backend name,
+// defaulting to "queue" to preserve the historical behavior of going
+// through queue.Factory().
+func logBrokerBackend() string {
+	backend, err := config.GetString("log:broker")
+	if err != nil || backend == "" {
+		return "queue"
+	}
+	return backend
+}
+
+func newLogBroker() (LogBroker, error) {
+	name := logBrokerBackend()
+	factory, ok := logBrokerFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("app: unknown log broker backend %q", name)
+	}
+	return factory()
+}
+
+var (
+	sharedBrokerMu sync.Mutex
+	sharedBroker   LogBroker
+)
+
+// sharedLogBroker returns a single LogBroker shared by every call to
+// notify and NewLogListener, built lazily on first use. notify in
+// particular is called once per log message, so backends like nats and
+// kafka that open real connections must not be recreated on every call;
+// unlike LogStorage, which is already one-per-dispatcher, there's no
+// natural owner to attach a broker's lifetime to, so it lives for the
+// process' lifetime instead.
+func sharedLogBroker() (LogBroker, error) {
+	sharedBrokerMu.Lock()
+	defer sharedBrokerMu.Unlock()
+	if sharedBroker != nil {
+		return sharedBroker, nil
+	}
+	b, err := newLogBroker()
+	if err != nil {
+		return nil, err
+	}
+	sharedBroker = b
+	return sharedBroker, nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/log"
+)
+
+func init() {
+	RegisterLogBroker("kafka", newKafkaLogBroker)
+}
+
+// kafkaLogBroker ships log entries through Kafka. By default each app
+// gets its own topic ("app-<name>"); set log:broker:kafka:single-topic
+// to use one shared topic instead, with the app name as the message
+// key, for deployments where per-app topics don't scale.
+type kafkaLogBroker struct {
+	singleTopic bool
+	topic       string
+	producer    sarama.SyncProducer
+	consumer    sarama.Consumer
+}
+
+func newKafkaLogBroker() (LogBroker, error) {
+	brokersCfg, err := config.GetString("log:broker:kafka:brokers")
+	if err != nil || brokersCfg == "" {
+		return nil, fmt.Errorf("app: log:broker:kafka:brokers is required")
+	}
+	brokers := strings.Split(brokersCfg, ",")
+	singleTopic, _ := config.GetBool("log:broker:kafka:single-topic")
+	topic, _ := config.GetString("log:broker:kafka:topic")
+	if topic == "" {
+		topic = "tsuru-logs"
+	}
+	cfg := sarama.NewConfig()
+	cfg.Producer.Return.Successes = true
+	producer, err := sarama.NewSyncProducer(brokers, cfg)
+	if err != nil {
+		return nil, err
+	}
+	consumer, err := sarama.NewConsumer(brokers, nil)
+	if err != nil {
+		producer.Close()
+		return nil, err
+	}
+	return &kafkaLogBroker{singleTopic: singleTopic, topic: topic, producer: producer, consumer: consumer}, nil
+}
+
+func (b *kafkaLogBroker) topicFor(appName string) string {
+	if b.singleTopic {
+		return b.topic
+	}
+	return "app-" + appName
+}
+
+func (b *kafkaLogBroker) Publish(appName string, entry *Applog) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	msg := &sarama.ProducerMessage{
+		Topic: b.topicFor(appName),
+		Value: sarama.ByteEncoder(data),
+	}
+	if b.singleTopic {
+		msg.Key = sarama.StringEncoder(appName)
+	}
+	_, _, err = b.producer.SendMessage(msg)
+	return err
+}
+
+func (b *kafkaLogBroker) Subscribe(ctx context.Context, appName string, filter Applog) (<-chan Applog, error) {
+	partitionConsumer, err := b.consumer.ConsumePartition(b.topicFor(appName), 0, sarama.OffsetNewest)
+	if err != nil {
+		return nil, err
+	}
+	logger := log.With(log.Field{Key: "app", Value: appName})
+	c := make(chan Applog, 10)
+	go func() {
+		defer close(c)
+		defer partitionConsumer.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-partitionConsumer.Messages():
+				if !ok {
+					return
+				}
+				if b.singleTopic && string(msg.Key) != appName {
+					continue
+				}
+				applog := Applog{}
+				if err := json.Unmarshal(msg.Value, &applog); err != nil {
+					logger.Error("unparsable log message, ignoring", log.Field{Key: "raw", Value: string(msg.Value)})
+					continue
+				}
+				if (filter.Source != "" && filter.Source != applog.Source) ||
+					(filter.Unit != "" && filter.Unit != applog.Unit) {
+					continue
+				}
+				select {
+				case c <- applog:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return c, nil
+}
+
+func (b *kafkaLogBroker) Close() error {
+	b.producer.Close()
+	return b.consumer.Close()
+}
@@ -0,0 +1,83 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/nats-io/nats.go"
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/log"
+)
+
+func init() {
+	RegisterLogBroker("nats", newNatsLogBroker)
+}
+
+// natsLogBroker ships log entries over NATS, one subject per app
+// ("logs.<app>"), enabling horizontal scaling of log fan-out across
+// yati nodes without a shared queue database.
+type natsLogBroker struct {
+	conn *nats.Conn
+}
+
+func natsSubject(appName string) string {
+	return "logs." + appName
+}
+
+func newNatsLogBroker() (LogBroker, error) {
+	url, err := config.GetString("log:broker:nats:url")
+	if err != nil || url == "" {
+		url = nats.DefaultURL
+	}
+	conn, err := nats.Connect(url)
+	if err != nil {
+		return nil, err
+	}
+	return &natsLogBroker{conn: conn}, nil
+}
+
+func (b *natsLogBroker) Publish(appName string, entry *Applog) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return b.conn.Publish(natsSubject(appName), data)
+}
+
+func (b *natsLogBroker) Subscribe(ctx context.Context, appName string, filter Applog) (<-chan Applog, error) {
+	logger := log.With(log.Field{Key: "app", Value: appName})
+	c := make(chan Applog, 10)
+	sub, err := b.conn.Subscribe(natsSubject(appName), func(msg *nats.Msg) {
+		applog := Applog{}
+		if err := json.Unmarshal(msg.Data, &applog); err != nil {
+			logger.Error("unparsable log message, ignoring", log.Field{Key: "raw", Value: string(msg.Data)})
+			return
+		}
+		if (filter.Source != "" && filter.Source != applog.Source) ||
+			(filter.Unit != "" && filter.Unit != applog.Unit) {
+			return
+		}
+		select {
+		case c <- applog:
+		case <-ctx.Done():
+		}
+	})
+	if err != nil {
+		close(c)
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		sub.Unsubscribe()
+		close(c)
+	}()
+	return c, nil
+}
+
+func (b *natsLogBroker) Close() error {
+	return b.conn.Drain()
+}
@@ -0,0 +1,89 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/tsuru/tsuru/log"
+	"github.com/tsuru/tsuru/queue"
+)
+
+func init() {
+	RegisterLogBroker("queue", newQueueLogBroker)
+}
+
+// queueLogBroker is the original notify/NewLogListener transport, kept
+// as the default backend on top of queue.Factory.
+type queueLogBroker struct {
+	factory queue.QFactory
+}
+
+func newQueueLogBroker() (LogBroker, error) {
+	factory, err := queue.Factory()
+	if err != nil {
+		return nil, err
+	}
+	return &queueLogBroker{factory: factory}, nil
+}
+
+func (b *queueLogBroker) Publish(appName string, entry *Applog) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	pubSubQ, err := b.factory.PubSub(logQueueName(appName))
+	if err != nil {
+		return err
+	}
+	return pubSubQ.Pub(data)
+}
+
+func (b *queueLogBroker) Subscribe(ctx context.Context, appName string, filter Applog) (<-chan Applog, error) {
+	pubSubQ, err := b.factory.PubSub(logQueueName(appName))
+	if err != nil {
+		return nil, err
+	}
+	subChan, err := pubSubQ.Sub()
+	if err != nil {
+		return nil, err
+	}
+	logger := log.With(log.Field{Key: "app", Value: appName})
+	c := make(chan Applog, 10)
+	go func() {
+		defer close(c)
+		defer pubSubQ.UnSub()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-subChan:
+				if !ok {
+					return
+				}
+				applog := Applog{}
+				if err := json.Unmarshal(msg, &applog); err != nil {
+					logger.Error("unparsable log message, ignoring", log.Field{Key: "raw", Value: string(msg)})
+					continue
+				}
+				if (filter.Source != "" && filter.Source != applog.Source) ||
+					(filter.Unit != "" && filter.Unit != applog.Unit) {
+					continue
+				}
+				select {
+				case c <- applog:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return c, nil
+}
+
+func (b *queueLogBroker) Close() error {
+	return nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"fmt"
+
+	"github.com/tsuru/config"
+)
+
+// LogStorage is the transport-specific sink appLogDispatcher bulk inserts
+// application logs into. Implementations own framing and delivery to the
+// underlying store; the dispatcher owns only batching and retry.
+type LogStorage interface {
+	Insert(appName string, entries []*Applog) error
+	Close() error
+}
+
+// LogStorageFactory builds a LogStorage from configuration. Factories are
+// called lazily, once per appLogDispatcher, so they may open connections
+// or other per-dispatcher resources.
+type LogStorageFactory func() (LogStorage, error)
+
+var logStorageFactories = make(map[string]LogStorageFactory)
+
+// RegisterLogStorage makes a LogStorage backend available under name,
+// mirroring the way iaas providers are registered. It's meant to be
+// called from the init function of packages implementing LogStorage.
+func RegisterLogStorage(name string, factory LogStorageFactory) {
+	logStorageFactories[name] = factory
+}
+
+// logStorageBackend returns the configured "log:storage" backend name,
+// defaulting to "mongodb" to preserve the historical behavior of
+// appLogDispatcher.
+func logStorageBackend() string {
+	backend, err := config.GetString("log:storage")
+	if err != nil || backend == "" {
+		return "mongodb"
+	}
+	return backend
+}
+
+// newLogStorage instantiates the configured LogStorage backend.
+func newLogStorage() (LogStorage, error) {
+	name := logStorageBackend()
+	factory, ok := logStorageFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("app: unknown log storage backend %q", name)
+	}
+	return factory()
+}
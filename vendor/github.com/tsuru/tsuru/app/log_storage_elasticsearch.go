@@ -0,0 +1,84 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/tsuru/config"
+)
+
+func init() {
+	RegisterLogStorage("elasticsearch", newElasticsearchLogStorage)
+}
+
+// elasticsearchLogStorage ships log entries to an Elasticsearch (or
+// OpenSearch) cluster using the _bulk API, one index action per entry.
+// The target index defaults to "tsuru-logs" and is shared across apps;
+// appName is kept as a field on the document for filtering.
+type elasticsearchLogStorage struct {
+	url    string
+	index  string
+	client *http.Client
+}
+
+func newElasticsearchLogStorage() (LogStorage, error) {
+	url, err := config.GetString("log:storage:elasticsearch:url")
+	if err != nil || url == "" {
+		return nil, fmt.Errorf("app: log:storage:elasticsearch:url is required")
+	}
+	index, err := config.GetString("log:storage:elasticsearch:index")
+	if err != nil || index == "" {
+		index = "tsuru-logs"
+	}
+	return &elasticsearchLogStorage{
+		url:    url,
+		index:  index,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (s *elasticsearchLogStorage) Insert(appName string, entries []*Applog) error {
+	var buf bytes.Buffer
+	action := map[string]interface{}{"index": map[string]interface{}{"_index": s.index}}
+	for _, entry := range entries {
+		actionLine, err := json.Marshal(action)
+		if err != nil {
+			return err
+		}
+		doc := map[string]interface{}{
+			"app":     appName,
+			"date":    entry.Date,
+			"source":  entry.Source,
+			"unit":    entry.Unit,
+			"message": entry.Message,
+		}
+		docLine, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		buf.Write(actionLine)
+		buf.WriteByte('\n')
+		buf.Write(docLine)
+		buf.WriteByte('\n')
+	}
+	resp, err := s.client.Post(s.url+"/_bulk", "application/x-ndjson", &buf)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("app: elasticsearch bulk insert failed with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *elasticsearchLogStorage) Close() error {
+	return nil
+}
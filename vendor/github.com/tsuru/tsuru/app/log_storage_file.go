@@ -0,0 +1,55 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/tsuru/config"
+)
+
+func init() {
+	RegisterLogStorage("file", newFileLogStorage)
+}
+
+// fileLogStorage writes one JSON object per log entry to a configured
+// file, or to stdout when "log:storage:file:path" is unset or "-". It's
+// meant for deployments that want to ship application logs to an
+// external collector (e.g. a sidecar tailing the file) instead of Mongo.
+type fileLogStorage struct {
+	out    io.Writer
+	closer io.Closer
+}
+
+func newFileLogStorage() (LogStorage, error) {
+	path, err := config.GetString("log:storage:file:path")
+	if err != nil || path == "" || path == "-" {
+		return &fileLogStorage{out: os.Stdout}, nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileLogStorage{out: f, closer: f}, nil
+}
+
+func (s *fileLogStorage) Insert(appName string, entries []*Applog) error {
+	enc := json.NewEncoder(s.out)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileLogStorage) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
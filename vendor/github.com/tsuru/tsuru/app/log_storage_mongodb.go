@@ -0,0 +1,39 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import "github.com/tsuru/tsuru/db"
+
+func init() {
+	RegisterLogStorage("mongodb", newMongoLogStorage)
+}
+
+// mongoLogStorage is the original appLogDispatcher sink, kept as the
+// default backend. It keeps a single log connection open for its
+// lifetime and reuses it for every Insert call.
+type mongoLogStorage struct {
+	conn *db.Storage
+}
+
+func newMongoLogStorage() (LogStorage, error) {
+	conn, err := db.LogConn()
+	if err != nil {
+		return nil, err
+	}
+	return &mongoLogStorage{conn: conn}, nil
+}
+
+func (s *mongoLogStorage) Insert(appName string, entries []*Applog) error {
+	docs := make([]interface{}, len(entries))
+	for i, entry := range entries {
+		docs[i] = entry
+	}
+	return s.conn.Logs(appName).Insert(docs...)
+}
+
+func (s *mongoLogStorage) Close() error {
+	s.conn.Close()
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tsuru/tsuru/log"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+// mockLogStorage fails the first failUntil calls to Insert, then
+// succeeds, recording every entry it was asked to persist.
+type mockLogStorage struct {
+	failUntil int
+	calls     int
+	inserted  []*Applog
+}
+
+func (s *mockLogStorage) Insert(appName string, entries []*Applog) error {
+	s.calls++
+	if s.calls <= s.failUntil {
+		return fmt.Errorf("mockLogStorage: simulated failure %d", s.calls)
+	}
+	s.inserted = append(s.inserted, entries...)
+	return nil
+}
+
+func (s *mockLogStorage) Close() error { return nil }
+
+func (s *S) SetUpTest(c *check.C) {
+	initialFlushBackoff = time.Millisecond
+	maxFlushBackoff = 10 * time.Millisecond
+}
+
+func (s *S) TestInsertWithRetrySucceedsAfterTransientFailures(c *check.C) {
+	MaxFlushRetries = 5
+	storage := &mockLogStorage{failUntil: 2}
+	d := &appLogDispatcher{appName: "myapp", logger: log.With()}
+	entries := []*Applog{{AppName: "myapp", Message: "hi"}}
+	err := d.insertWithRetry(storage, entries)
+	c.Assert(err, check.IsNil)
+	c.Assert(storage.calls, check.Equals, 3)
+	c.Assert(storage.inserted, check.DeepEquals, entries)
+}
+
+func (s *S) TestInsertWithRetryGivesUpAfterMaxRetries(c *check.C) {
+	MaxFlushRetries = 2
+	storage := &mockLogStorage{failUntil: 100}
+	d := &appLogDispatcher{appName: "myapp", logger: log.With()}
+	err := d.insertWithRetry(storage, []*Applog{{AppName: "myapp"}})
+	c.Assert(err, check.NotNil)
+	c.Assert(storage.calls, check.Equals, MaxFlushRetries+1)
+}
@@ -0,0 +1,61 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Prometheus instrumentation for the log dispatch pipeline: messages
+// received from the WS ingestion point, bulk flush latency and size,
+// channel saturation (otherwise invisible back-pressure) and pub/sub
+// fan-out health.
+var (
+	logMessagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "yati_log_messages_received_total",
+		Help: "Total number of log messages accepted for dispatch, per app.",
+	}, []string{"app"})
+
+	logBulkFlushDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "yati_log_bulk_flush_duration_seconds",
+		Help: "Time spent flushing a bulk of log entries to the log storage, per app.",
+	}, []string{"app"})
+
+	logBulkSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "yati_log_bulk_size",
+		Help:    "Number of log entries flushed per bulk insert.",
+		Buckets: prometheus.LinearBuckets(10, 10, 10),
+	})
+
+	logChannelDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "yati_log_channel_depth",
+		Help: "Number of messages currently buffered in an app's dispatcher channel.",
+	}, []string{"app"})
+
+	logPubSubPublishErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "yati_log_pubsub_publish_errors_total",
+		Help: "Total number of errors publishing a log message to the pub/sub queue, per app.",
+	}, []string{"app"})
+
+	logListenerActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "yati_log_listener_active",
+		Help: "Number of active log listeners subscribed to an app's log queue.",
+	}, []string{"app"})
+
+	logMessagesDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "yati_log_dropped_total",
+		Help: "Total number of log messages dropped by Send because the dispatcher's channel stayed full, per app.",
+	}, []string{"app"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		logMessagesReceived,
+		logBulkFlushDuration,
+		logBulkSize,
+		logChannelDepth,
+		logPubSubPublishErrors,
+		logListenerActive,
+		logMessagesDropped,
+	)
+}
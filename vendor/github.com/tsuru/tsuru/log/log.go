@@ -0,0 +1,228 @@
+// Copyright 2015 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package log provides the logging facility used throughout tsuru. It
+// exposes a simple Logger interface for free-form messages and a
+// separate, leveled FieldLogger for structured logging with inherited
+// key/value context.
+//
+// The only FieldLogger backends built into this package ("json" and
+// "text" below) are dependency-free writers around encoding/json and
+// fmt. There is no zerolog or zap integration here: wiring one in means
+// implementing FieldLogger against that library's logger and calling
+// RegisterFieldLoggerBackend (or SetFieldLogger directly) from the
+// process that vendors it, the same way LogStorage and LogBroker
+// backends plug into the app package.
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tsuru/config"
+)
+
+// Logger is the classic tsuru logging interface, kept for backward
+// compatibility with code that only wants to write free-form messages.
+type Logger interface {
+	Error(string)
+	Errorf(string, ...interface{})
+	Debug(string)
+	Debugf(string, ...interface{})
+}
+
+// Field is a single key/value pair attached to a log entry.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// FieldLogger is a leveled logger that carries structured context fields.
+// Fields attached with With are inherited by every entry written through
+// the returned logger, and by any further logger derived from it.
+type FieldLogger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+	With(fields ...Field) FieldLogger
+}
+
+var (
+	mut         sync.RWMutex
+	target      Logger
+	fieldTarget FieldLogger = newJSONFieldLogger(os.Stderr)
+)
+
+// SetLogger defines the Logger used by the package level Error, Errorf,
+// Debug and Debugf functions.
+func SetLogger(l Logger) {
+	mut.Lock()
+	defer mut.Unlock()
+	target = l
+}
+
+// GetLogger returns the Logger currently in use, if any.
+func GetLogger() Logger {
+	mut.RLock()
+	defer mut.RUnlock()
+	return target
+}
+
+// SetFieldLogger defines the FieldLogger that With derives its loggers
+// from.
+func SetFieldLogger(l FieldLogger) {
+	mut.Lock()
+	defer mut.Unlock()
+	fieldTarget = l
+}
+
+// GetFieldLogger returns the FieldLogger currently in use.
+func GetFieldLogger() FieldLogger {
+	mut.RLock()
+	defer mut.RUnlock()
+	return fieldTarget
+}
+
+// With returns a FieldLogger carrying the given fields, derived from the
+// currently configured FieldLogger. Use it to attach per-app, per-unit or
+// per-request context once and reuse it across a batch of log calls:
+//
+//	logger := log.With(log.Field{Key: "app", Value: appName})
+//	logger.Error("failed to flush logs", log.Field{Key: "retry", Value: n})
+func With(fields ...Field) FieldLogger {
+	return GetFieldLogger().With(fields...)
+}
+
+func Error(msg string) {
+	l := GetLogger()
+	if l != nil {
+		l.Error(msg)
+	}
+}
+
+func Errorf(format string, v ...interface{}) {
+	l := GetLogger()
+	if l != nil {
+		l.Errorf(format, v...)
+	}
+}
+
+func Debug(msg string) {
+	l := GetLogger()
+	if l != nil {
+		l.Debug(msg)
+	}
+}
+
+func Debugf(format string, v ...interface{}) {
+	l := GetLogger()
+	if l != nil {
+		l.Debugf(format, v...)
+	}
+}
+
+// FieldLoggerBackendFactory builds a FieldLogger writing to out.
+type FieldLoggerBackendFactory func(out io.Writer) FieldLogger
+
+var fieldLoggerBackends = map[string]FieldLoggerBackendFactory{
+	"json": newJSONFieldLogger,
+	"text": newTextFieldLogger,
+}
+
+// RegisterFieldLoggerBackend makes a FieldLogger backend available under
+// name, for selection via the "log:backend" config entry and Init. This
+// is the extension point for a zerolog- or zap-backed FieldLogger: a
+// package depending on one of those libraries registers an adapter here
+// from its own init function instead of this package taking the
+// dependency directly.
+func RegisterFieldLoggerBackend(name string, factory FieldLoggerBackendFactory) {
+	fieldLoggerBackends[name] = factory
+}
+
+// Init configures the package level FieldLogger based on the "log:backend"
+// config entry, defaulting to "json" (one JSON object per line to
+// stderr) when unset. "text" (human readable key=value pairs) is also
+// built in; any name registered with RegisterFieldLoggerBackend works
+// too.
+func Init() error {
+	backend, err := config.GetString("log:backend")
+	if err != nil || backend == "" {
+		backend = "json"
+	}
+	factory, ok := fieldLoggerBackends[backend]
+	if !ok {
+		return fmt.Errorf("log: unknown backend %q", backend)
+	}
+	SetFieldLogger(factory(os.Stderr))
+	return nil
+}
+
+type entry struct {
+	Time   time.Time              `json:"time"`
+	Level  string                 `json:"level"`
+	Msg    string                 `json:"msg"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+type baseFieldLogger struct {
+	out    io.Writer
+	fields []Field
+	write  func(io.Writer, string, string, []Field)
+}
+
+func (l *baseFieldLogger) With(fields ...Field) FieldLogger {
+	merged := make([]Field, 0, len(l.fields)+len(fields))
+	merged = append(merged, l.fields...)
+	merged = append(merged, fields...)
+	return &baseFieldLogger{out: l.out, fields: merged, write: l.write}
+}
+
+func (l *baseFieldLogger) log(level, msg string, fields []Field) {
+	all := make([]Field, 0, len(l.fields)+len(fields))
+	all = append(all, l.fields...)
+	all = append(all, fields...)
+	l.write(l.out, level, msg, all)
+}
+
+func (l *baseFieldLogger) Debug(msg string, fields ...Field) { l.log("debug", msg, fields) }
+func (l *baseFieldLogger) Info(msg string, fields ...Field)  { l.log("info", msg, fields) }
+func (l *baseFieldLogger) Warn(msg string, fields ...Field)  { l.log("warn", msg, fields) }
+func (l *baseFieldLogger) Error(msg string, fields ...Field) { l.log("error", msg, fields) }
+
+func newJSONFieldLogger(out io.Writer) FieldLogger {
+	return &baseFieldLogger{out: out, write: writeJSON}
+}
+
+func writeJSON(out io.Writer, level, msg string, fields []Field) {
+	e := entry{Time: time.Now(), Level: level, Msg: msg}
+	if len(fields) > 0 {
+		e.Fields = make(map[string]interface{}, len(fields))
+		for _, f := range fields {
+			e.Fields[f.Key] = f.Value
+		}
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		fmt.Fprintf(out, "level=error msg=\"failed to marshal log entry: %s\"\n", err)
+		return
+	}
+	out.Write(append(data, '\n'))
+}
+
+func newTextFieldLogger(out io.Writer) FieldLogger {
+	return &baseFieldLogger{out: out, write: writeText}
+}
+
+func writeText(out io.Writer, level, msg string, fields []Field) {
+	fmt.Fprintf(out, "%s level=%s msg=%q", time.Now().Format(time.RFC3339), level, msg)
+	for _, f := range fields {
+		fmt.Fprintf(out, " %s=%v", f.Key, f.Value)
+	}
+	fmt.Fprintln(out)
+}